@@ -0,0 +1,181 @@
+package chserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Metrics accumulates the counters and gauges chserver exposes at
+///metrics (Prometheus text format) and /sessions (JSON). All methods
+//are safe for concurrent use
+type Metrics struct {
+	wsHandshakes int64
+	authFailures int64
+
+	mu                sync.Mutex
+	userConcurrency   map[string]int64
+	userStreamsOpened map[string]int64
+	userStreamsClosed map[string]int64
+	remoteBytesSent   map[string]int64
+	remoteBytesRecv   map[string]int64
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		userConcurrency:   map[string]int64{},
+		userStreamsOpened: map[string]int64{},
+		userStreamsClosed: map[string]int64{},
+		remoteBytesSent:   map[string]int64{},
+		remoteBytesRecv:   map[string]int64{},
+	}
+}
+
+func (m *Metrics) handshake() {
+	atomic.AddInt64(&m.wsHandshakes, 1)
+}
+
+func (m *Metrics) authFailure() {
+	atomic.AddInt64(&m.authFailures, 1)
+}
+
+//streamOpen records a new in-flight stream for user ("" when auth is disabled)
+func (m *Metrics) streamOpen(user string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.userStreamsOpened[user]++
+	m.userConcurrency[user]++
+}
+
+func (m *Metrics) streamClose(user string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.userStreamsClosed[user]++
+	m.userConcurrency[user]--
+}
+
+//bytes records a completed dial's transferred byte counts against its
+//destination, as reported through chshare.TunnelHooks.Bytes
+func (m *Metrics) bytes(remote string, sent, recv int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remoteBytesSent[remote] += sent
+	m.remoteBytesRecv[remote] += recv
+}
+
+//WriteProm renders all metrics in the Prometheus text exposition format
+func (m *Metrics) WriteProm(w io.Writer, activeSessions int64) {
+	fmt.Fprintf(w, "# HELP chisel_ws_handshakes_total Completed SSH handshakes, across all transports\n")
+	fmt.Fprintf(w, "# TYPE chisel_ws_handshakes_total counter\n")
+	fmt.Fprintf(w, "chisel_ws_handshakes_total %d\n", atomic.LoadInt64(&m.wsHandshakes))
+
+	fmt.Fprintf(w, "# HELP chisel_auth_failures_total Rejected authentication attempts\n")
+	fmt.Fprintf(w, "# TYPE chisel_auth_failures_total counter\n")
+	fmt.Fprintf(w, "chisel_auth_failures_total %d\n", atomic.LoadInt64(&m.authFailures))
+
+	fmt.Fprintf(w, "# HELP chisel_active_sessions Currently connected client sessions\n")
+	fmt.Fprintf(w, "# TYPE chisel_active_sessions gauge\n")
+	fmt.Fprintf(w, "chisel_active_sessions %d\n", activeSessions)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP chisel_user_concurrent_streams Streams currently open, by user\n")
+	fmt.Fprintf(w, "# TYPE chisel_user_concurrent_streams gauge\n")
+	for _, user := range sortedKeys(m.userConcurrency) {
+		fmt.Fprintf(w, "chisel_user_concurrent_streams{user=%q} %d\n", user, m.userConcurrency[user])
+	}
+
+	fmt.Fprintf(w, "# HELP chisel_user_streams_opened_total Streams opened, by user\n")
+	fmt.Fprintf(w, "# TYPE chisel_user_streams_opened_total counter\n")
+	for _, user := range sortedKeys(m.userStreamsOpened) {
+		fmt.Fprintf(w, "chisel_user_streams_opened_total{user=%q} %d\n", user, m.userStreamsOpened[user])
+	}
+
+	fmt.Fprintf(w, "# HELP chisel_user_streams_closed_total Streams closed, by user\n")
+	fmt.Fprintf(w, "# TYPE chisel_user_streams_closed_total counter\n")
+	for _, user := range sortedKeys(m.userStreamsClosed) {
+		fmt.Fprintf(w, "chisel_user_streams_closed_total{user=%q} %d\n", user, m.userStreamsClosed[user])
+	}
+
+	fmt.Fprintf(w, "# HELP chisel_remote_bytes_sent_total Bytes sent towards a dialled remote\n")
+	fmt.Fprintf(w, "# TYPE chisel_remote_bytes_sent_total counter\n")
+	for _, remote := range sortedKeys(m.remoteBytesSent) {
+		fmt.Fprintf(w, "chisel_remote_bytes_sent_total{remote=%q} %d\n", remote, m.remoteBytesSent[remote])
+	}
+
+	fmt.Fprintf(w, "# HELP chisel_remote_bytes_received_total Bytes received from a dialled remote\n")
+	fmt.Fprintf(w, "# TYPE chisel_remote_bytes_received_total counter\n")
+	for _, remote := range sortedKeys(m.remoteBytesRecv) {
+		fmt.Fprintf(w, "chisel_remote_bytes_received_total{remote=%q} %d\n", remote, m.remoteBytesRecv[remote])
+	}
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//checkMetricsToken reports whether r is authorised to read the
+//metrics/sessions endpoints. An empty s.metricsToken disables the check
+func (s *Server) checkMetricsToken(r *http.Request) bool {
+	if s.metricsToken == "" {
+		return true
+	}
+	return r.URL.Query().Get("token") == s.metricsToken ||
+		r.Header.Get("Authorization") == "Bearer "+s.metricsToken
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !s.checkMetricsToken(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.sessionsMu.Lock()
+	active := int64(len(s.activeSessions))
+	s.sessionsMu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.WriteProm(w, active)
+}
+
+//sessionView is the JSON shape returned by /sessions
+type sessionView struct {
+	ID      int    `json:"id"`
+	User    string `json:"user"`
+	Remotes string `json:"remotes"`
+	AgeSecs int    `json:"age_secs"`
+	Sent    int64  `json:"bytes_sent"`
+	Recv    int64  `json:"bytes_received"`
+}
+
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if !s.checkMetricsToken(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.sessionsMu.Lock()
+	views := make([]sessionView, 0, len(s.activeSessions))
+	for _, rec := range s.activeSessions {
+		views = append(views, sessionView{
+			ID:      rec.id,
+			User:    rec.user,
+			Remotes: rec.remotes,
+			AgeSecs: int(time.Since(rec.start).Seconds()),
+			Sent:    atomic.LoadInt64(&rec.sent),
+			Recv:    atomic.LoadInt64(&rec.recv),
+		})
+	}
+	s.sessionsMu.Unlock()
+	sort.Slice(views, func(i, j int) bool { return views[i].ID < views[j].ID })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
@@ -1,13 +1,21 @@
 package chserver
 
 import (
+	"crypto/tls"
 	"errors"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jpillora/chisel/share"
+	"github.com/jpillora/sizestr"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/net/websocket"
 )
@@ -22,16 +30,89 @@ type Server struct {
 	proxy       *httputil.ReverseProxy
 	sshConfig   *ssh.ServerConfig
 	sessions    map[string]*chshare.User
+	socks5      bool
+	transports  []Transport
+	tlsConfig   *tls.Config
+	muxListener net.Listener
+	muxDone     chan struct{}
+	resumeGrace time.Duration
+	tunnelsMu   sync.Mutex
+	tunnels     map[string]*tunnelSession
+
+	metrics        *Metrics
+	metricsToken   string
+	sessionsMu     sync.Mutex
+	activeSessions map[int]*sessionRecord
+}
+
+//sessionRecord is the live bookkeeping behind one row of the /sessions
+//JSON endpoint
+type sessionRecord struct {
+	id      int
+	user    string
+	remotes string
+	start   time.Time
+	sent    int64
+	recv    int64
 }
 
-func NewServer(keySeed, authfile, proxy string) (*Server, error) {
+//tunnelSession keeps a Tunnel (and its in-flight streams) alive for
+//resumeGrace after its ssh.Conn disconnects, so a client reconnecting
+//with the same Config.SessionID can re-attach instead of starting over
+type tunnelSession struct {
+	tunnel *chshare.Tunnel
+	timer  *time.Timer
+}
+
+//NewServer creates a Server. transport is a comma separated list drawn
+//from "ws" (always implied), "connect" and "tls"; tlsCert/tlsKey are only
+//required when "tls" is included. The tls transport shares the same
+//listening port as everything else - see serveMuxed - so it needs no
+//address of its own. resumeGrace is how long a disconnected session's
+//Tunnel is kept around for resumption; zero disables resumption
+//entirely. metricsToken, if non-empty, must be presented (as ?token= or
+//a Bearer header) to read /metrics or /sessions
+func NewServer(keySeed, authfile, proxy string, socks5 bool, transport, tlsCert, tlsKey string, resumeGrace time.Duration, metricsToken string) (*Server, error) {
 	s := &Server{
-		Logger:     chshare.NewLogger("server"),
-		wsServer:   websocket.Server{},
-		httpServer: chshare.NewHTTPServer(),
-		sessions:   map[string]*chshare.User{},
+		Logger:         chshare.NewLogger("server"),
+		wsServer:       websocket.Server{},
+		httpServer:     chshare.NewHTTPServer(),
+		sessions:       map[string]*chshare.User{},
+		socks5:         socks5,
+		resumeGrace:    resumeGrace,
+		tunnels:        map[string]*tunnelSession{},
+		metrics:        newMetrics(),
+		metricsToken:   metricsToken,
+		activeSessions: map[int]*sessionRecord{},
+	}
+	s.wsServer.Handler = websocket.Handler(func(ws *websocket.Conn) {
+		s.handleSSH(ws)
+	})
+
+	//always accept websocket, then layer on any opt-in transports
+	s.transports = []Transport{&wsTransport{s}}
+	for _, name := range strings.Split(transport, ",") {
+		switch strings.TrimSpace(name) {
+		case "", "ws":
+			//already added above
+		case "connect":
+			s.transports = append(s.transports, &connectTransport{s})
+		case "tls":
+			if tlsCert == "" || tlsKey == "" {
+				return nil, s.Errorf("tls transport requires a cert and key")
+			}
+			cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+			if err != nil {
+				return nil, err
+			}
+			s.tlsConfig = &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				NextProtos:   []string{"chisel", "http/1.1"},
+			}
+		default:
+			return nil, s.Errorf("unknown transport '%s'", name)
+		}
 	}
-	s.wsServer.Handler = websocket.Handler(s.handleWS)
 
 	//parse users, if provided
 	if authfile != "" {
@@ -93,27 +174,170 @@ func (s *Server) Start(host, port string) error {
 	if s.proxy != nil {
 		s.Infof("Default proxy enabled")
 	}
+	if s.socks5 {
+		s.Infof("SOCKS5 enabled")
+	}
 	s.Infof("Listening on %s...", port)
 
-	return s.httpServer.GoListenAndServe(":"+port, http.HandlerFunc(s.handleHTTP))
+	addr := ":" + port
+	if s.tlsConfig == nil {
+		return s.httpServer.GoListenAndServe(addr, http.HandlerFunc(s.handleHTTP))
+	}
+
+	//the tls transport has to share this same port with plain HTTP (and,
+	//if enabled, with ordinary HTTPS via s.proxy) rather than open a port
+	//of its own, so a chisel-over-TLS client is indistinguishable from
+	//any other HTTPS traffic reaching this address - see serveMuxed
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.muxListener = l
+	s.muxDone = make(chan struct{})
+	go s.serveMuxed(l)
+	return nil
+}
+
+//tlsRecordHandshake is the first byte of a TLS record carrying a
+//ClientHello - no valid HTTP request line starts with it, which is what
+//serveMuxed uses to tell the two apart
+const tlsRecordHandshake = 0x16
+
+//serveMuxed accepts every connection on the shared port and peeks its
+//first byte before treating it as anything: a byte of 0x16 marks a raw
+//TLS ClientHello, which goes to handleTLSConn for ALPN-based dispatch;
+//everything else is plaintext HTTP and is served as a single connection
+//through the usual mux. This keeps the tls transport on the one port
+//the server already listens on, instead of a second port of its own
+func (s *Server) serveMuxed(l net.Listener) {
+	defer close(s.muxDone)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.Debugf("Shared listener closed: %s", err)
+			return
+		}
+		go s.handleMuxedConn(conn)
+	}
+}
+
+func (s *Server) handleMuxedConn(conn net.Conn) {
+	lead := make([]byte, 1)
+	if _, err := io.ReadFull(conn, lead); err != nil {
+		conn.Close()
+		return
+	}
+	buffered := &bufferedConn{Conn: conn, pending: lead}
+	if lead[0] == tlsRecordHandshake {
+		s.handleTLSConn(tls.Server(buffered, s.tlsConfig))
+		return
+	}
+	http.Serve(newOneShotListener(buffered), http.HandlerFunc(s.handleHTTP))
+}
+
+//handleTLSConn completes the TLS handshake on conn and dispatches by the
+//negotiated protocol: "chisel" (the ALPN name clients request for this
+//tunnel) goes straight to the raw SSH path, bypassing handleHTTP
+//entirely; anything else falls through to the usual HTTP mux, so the
+//same shared listener also serves plain HTTPS
+func (s *Server) handleTLSConn(conn *tls.Conn) {
+	if err := conn.Handshake(); err != nil {
+		s.Debugf("TLS handshake failed: %s", err)
+		conn.Close()
+		return
+	}
+	if conn.ConnectionState().NegotiatedProtocol == "chisel" {
+		s.handleSSH(conn)
+		return
+	}
+	http.Serve(newOneShotListener(conn), http.HandlerFunc(s.handleHTTP))
+}
+
+//oneShotListener adapts a single already-accepted net.Conn to the
+//net.Listener interface expected by http.Serve, so a conn pulled off
+//serveMuxed's own accept loop can still be handed to the shared HTTP mux.
+//Accept returns the conn once, then blocks until it is closed
+type oneShotListener struct {
+	conn net.Conn
+	addr net.Addr
+	once sync.Once
+	done chan struct{}
+}
+
+func newOneShotListener(conn net.Conn) *oneShotListener {
+	l := &oneShotListener{addr: conn.LocalAddr(), done: make(chan struct{})}
+	l.conn = &closeNotifyConn{Conn: conn, onClose: l.Close}
+	return l
+}
+
+func (l *oneShotListener) Accept() (net.Conn, error) {
+	conn := l.conn
+	l.conn = nil
+	if conn == nil {
+		<-l.done
+		return nil, io.EOF
+	}
+	return conn, nil
+}
+
+func (l *oneShotListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *oneShotListener) Addr() net.Addr {
+	return l.addr
+}
+
+//closeNotifyConn wraps a net.Conn so closing it also closes the
+//oneShotListener that vended it, letting http.Serve's accept loop exit
+//once the single connection it's serving goes away
+type closeNotifyConn struct {
+	net.Conn
+	onClose func() error
+}
+
+func (c *closeNotifyConn) Close() error {
+	err := c.Conn.Close()
+	c.onClose()
+	return err
 }
 
 func (s *Server) Wait() error {
+	if s.muxListener != nil {
+		<-s.muxDone
+		return nil
+	}
 	return s.httpServer.Wait()
 }
 
 func (s *Server) Close() error {
+	if s.muxListener != nil {
+		//this should cause an error in serveMuxed's Accept loop
+		return s.muxListener.Close()
+	}
 	//this should cause an error in the open websockets
 	return s.httpServer.Close()
 }
 
 func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
-	//websockets upgrade AND has chisel prefix
-	if r.Header.Get("Upgrade") == "websocket" &&
-		r.Header.Get("Sec-WebSocket-Protocol") == chshare.ProtocolVersion {
-		s.wsServer.ServeHTTP(w, r)
+	//metrics/audit endpoints are checked first so they work
+	//regardless of whether a default proxy is configured
+	switch r.URL.Path {
+	case "/metrics":
+		s.handleMetrics(w, r)
+		return
+	case "/sessions":
+		s.handleSessions(w, r)
 		return
 	}
+	//dispatch to whichever transport recognises this request
+	for _, t := range s.transports {
+		if t.Detect(r) {
+			t.ServeHTTP(w, r)
+			return
+		}
+	}
 	//proxy target was provided
 	if s.proxy != nil {
 		s.proxy.ServeHTTP(w, r)
@@ -132,6 +356,7 @@ func (s *Server) authUser(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, er
 	// authenticate user
 	u, ok := s.Users[c.User()]
 	if !ok || u.Pass != string(pass) {
+		s.metrics.authFailure()
 		return nil, errors.New("Invalid auth")
 	}
 	//insert session
@@ -139,13 +364,16 @@ func (s *Server) authUser(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, er
 	return nil, nil
 }
 
-func (s *Server) handleWS(ws *websocket.Conn) {
+//handleSSH runs the chisel SSH server protocol over conn, regardless
+//of which Transport produced it (websocket, CONNECT or TLS)
+func (s *Server) handleSSH(conn net.Conn) {
 	// Before use, a handshake must be performed on the incoming net.Conn.
-	sshConn, chans, reqs, err := ssh.NewServerConn(ws, s.sshConfig)
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConfig)
 	if err != nil {
 		s.Debugf("Failed to handshake (%s)", err)
 		return
 	}
+	s.metrics.handshake()
 
 	//load user
 	sid := string(sshConn.SessionID())
@@ -177,8 +405,16 @@ func (s *Server) handleWS(ws *websocket.Conn) {
 	//access to the desired remote
 	if user != nil {
 		for _, r := range c.Remotes {
+			if r.Socks {
+				//gated dynamically per dial, see Tunnel's socks RuleSet
+				continue
+			}
 			addr := r.RemoteHost + ":" + r.RemotePort
-			if !user.HasAccess(addr) {
+			scheme := r.LocalProto
+			if scheme == "" {
+				scheme = "tcp"
+			}
+			if !user.HasAccess(scheme, addr) {
 				reply(s.Errorf("access to '%s' denied", addr))
 				return
 			}
@@ -190,13 +426,160 @@ func (s *Server) handleWS(ws *websocket.Conn) {
 	id := s.wsCount
 	l := s.Fork("session#%d", id)
 
+	//open any requested reverse (server-side) listeners,
+	//closing them all when the session ends
+	var reverseListeners []net.Listener
+	for _, rem := range c.Remotes {
+		if !rem.Reverse {
+			continue
+		}
+		listener, err := s.listenReverse(l, sshConn, rem)
+		if err != nil {
+			l.Infof("Reverse listen failed: %s", err)
+			continue
+		}
+		reverseListeners = append(reverseListeners, listener)
+	}
+
 	l.Debugf("Open")
-	go ssh.DiscardRequests(reqs)
-	go chshare.ConnectStreams(l, chans)
+	userName := ""
+	if user != nil {
+		userName = user.Name
+	}
+	rec := s.trackSession(id, userName, c.Remotes)
+	t := s.takeTunnel(c.SessionID, l, user)
+	t.SetHooks(chshare.TunnelHooks{
+		StreamOpen:  s.metrics.streamOpen,
+		StreamClose: s.metrics.streamClose,
+		Bytes: func(remote string, sent, recv int64) {
+			s.metrics.bytes(remote, sent, recv)
+			atomic.AddInt64(&rec.sent, sent)
+			atomic.AddInt64(&rec.recv, recv)
+		},
+	})
+	t.Serve(reqs, chans)
 	sshConn.Wait()
+	for _, listener := range reverseListeners {
+		listener.Close()
+	}
 	l.Debugf("Close")
 
 	if user != nil {
 		delete(s.sessions, sid)
 	}
+	s.releaseTunnel(c.SessionID, t)
+	s.untrackSession(id)
+}
+
+//trackSession registers a sessionRecord for the /sessions endpoint,
+//remembering who connected, what they asked for, and when
+func (s *Server) trackSession(id int, user string, remotes []*chshare.Remote) *sessionRecord {
+	specs := make([]string, len(remotes))
+	for i, r := range remotes {
+		specs[i] = r.String()
+	}
+	rec := &sessionRecord{
+		id:      id,
+		user:    user,
+		remotes: strings.Join(specs, ", "),
+		start:   time.Now(),
+	}
+	s.sessionsMu.Lock()
+	s.activeSessions[id] = rec
+	s.sessionsMu.Unlock()
+	return rec
+}
+
+func (s *Server) untrackSession(id int) {
+	s.sessionsMu.Lock()
+	delete(s.activeSessions, id)
+	s.sessionsMu.Unlock()
+}
+
+//takeTunnel returns the Tunnel left behind by a previous connection
+//carrying the same (non-empty) sessionID, cancelling its pending
+//cleanup, or creates a fresh one when there is nothing to resume, or
+//when the session belongs to a different user than the one reconnecting
+func (s *Server) takeTunnel(sessionID string, l *chshare.Logger, user *chshare.User) *chshare.Tunnel {
+	if sessionID != "" {
+		s.tunnelsMu.Lock()
+		if ts, ok := s.tunnels[sessionID]; ok {
+			ts.timer.Stop()
+			delete(s.tunnels, sessionID)
+			s.tunnelsMu.Unlock()
+			if !sameUser(ts.tunnel.User(), user) {
+				l.Infof("Refusing to resume session %s: reconnected as a different user", sessionID)
+				return chshare.NewTunnel(l, s.socks5, user)
+			}
+			l.Infof("Resuming session %s", sessionID)
+			return ts.tunnel
+		}
+		s.tunnelsMu.Unlock()
+	}
+	return chshare.NewTunnel(l, s.socks5, user)
+}
+
+//sameUser reports whether a and b are the same authenticated user (or
+//both nil, i.e. authentication disabled). Tunnel.user is fixed at
+//construction and gates every channel-open ACL decision for its
+//lifetime, so a resumed Tunnel must never be handed to a different user
+//than the one it was created for
+func sameUser(a, b *chshare.User) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Name == b.Name
+}
+
+//releaseTunnel either drops t immediately, or, when sessionID is set
+//and resumeGrace is positive, keeps it around for resumeGrace so a
+//reconnecting client can resume its in-flight streams
+func (s *Server) releaseTunnel(sessionID string, t *chshare.Tunnel) {
+	if sessionID == "" || s.resumeGrace <= 0 {
+		return
+	}
+	s.tunnelsMu.Lock()
+	defer s.tunnelsMu.Unlock()
+	s.tunnels[sessionID] = &tunnelSession{
+		tunnel: t,
+		timer: time.AfterFunc(s.resumeGrace, func() {
+			s.tunnelsMu.Lock()
+			delete(s.tunnels, sessionID)
+			s.tunnelsMu.Unlock()
+		}),
+	}
+}
+
+//listenReverse binds the local side of a reverse remote and, for each
+//accepted connection, opens a "chisel-reverse" channel back to the
+//client carrying the local_host:local_port it should dial
+func (s *Server) listenReverse(l *chshare.Logger, sshConn ssh.Conn, r *chshare.Remote) (net.Listener, error) {
+	addr := r.RemoteHost + ":" + r.RemotePort
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, s.Errorf("reverse listen %s: %s", addr, err)
+	}
+	l.Infof("Reverse forwarding %s => %s", addr, r.LocalHost+":"+r.LocalPort)
+	go func() {
+		for {
+			src, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleReverse(l, sshConn, r, src)
+		}
+	}()
+	return listener, nil
+}
+
+func (s *Server) handleReverse(l *chshare.Logger, sshConn ssh.Conn, r *chshare.Remote, src net.Conn) {
+	defer src.Close()
+	dst, reqs, err := sshConn.OpenChannel("chisel-reverse", []byte(r.LocalHost+":"+r.LocalPort))
+	if err != nil {
+		l.Debugf("Reverse stream error: %s", err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	sent, recv := chshare.Pipe(src, dst)
+	l.Debugf("Reverse conn closed (sent %s received %s)", sizestr.ToString(sent), sizestr.ToString(recv))
 }
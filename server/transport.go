@@ -0,0 +1,99 @@
+package chserver
+
+import (
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/jpillora/chisel/share"
+)
+
+//Transport is a pluggable mechanism for bootstrapping the chisel SSH
+//handshake over an incoming HTTP request. wsTransport (websocket) is
+//the default; connectTransport is opt-in via --transport and lets
+//chisel traverse middleboxes that mangle websockets. The "tls" transport
+//is also opt-in via --transport but isn't a Transport - see the note below
+type Transport interface {
+	Name() string
+	//Detect reports whether this transport should handle r
+	Detect(r *http.Request) bool
+	//ServeHTTP performs the transport-specific handshake and, on
+	//success, hands the raw connection to Server.handleSSH
+	ServeHTTP(w http.ResponseWriter, r *http.Request)
+}
+
+//wsTransport upgrades the request to a websocket, as chisel has
+//always done
+type wsTransport struct {
+	server *Server
+}
+
+func (t *wsTransport) Name() string { return "ws" }
+
+func (t *wsTransport) Detect(r *http.Request) bool {
+	return r.Header.Get("Upgrade") == "websocket" &&
+		r.Header.Get("Sec-WebSocket-Protocol") == chshare.ProtocolVersion
+}
+
+func (t *wsTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.server.wsServer.ServeHTTP(w, r)
+}
+
+//connectTransport bootstraps the SSH handshake over a hijacked HTTP
+//CONNECT tunnel, for use behind proxies that strip websocket upgrades
+type connectTransport struct {
+	server *Server
+}
+
+func (t *connectTransport) Name() string { return "connect" }
+
+func (t *connectTransport) Detect(r *http.Request) bool {
+	return r.Method == http.MethodConnect
+}
+
+func (t *connectTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "CONNECT not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		t.server.Debugf("CONNECT hijack failed: %s", err)
+		return
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		conn.Close()
+		return
+	}
+	//a client that doesn't wait for the 200 above may have already
+	//pipelined SSH handshake bytes, which Hijack leaves sitting in
+	//bufrw's buffer rather than on conn itself - replay them first
+	if n := bufrw.Reader.Buffered(); n > 0 {
+		pending := make([]byte, n)
+		io.ReadFull(bufrw.Reader, pending)
+		conn = &bufferedConn{Conn: conn, pending: pending}
+	}
+	t.server.handleSSH(conn)
+}
+
+//bufferedConn replays bytes an http.Hijacker's bufio.Reader had already
+//buffered before the next Read reaches the underlying net.Conn
+type bufferedConn struct {
+	net.Conn
+	pending []byte
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+//the "tls" transport isn't a Transport: it shares the server's one
+//listening port via Server.serveMuxed, which peeks each raw conn before
+//anything is parsed as HTTP, then dispatches on the negotiated ALPN
+//protocol of the ones that turn out to be TLS. See Server.handleTLSConn
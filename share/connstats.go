@@ -0,0 +1,32 @@
+package chshare
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+//ConnStats counts the connections a Tunnel has opened
+//and how many are currently active, for debug logging
+type ConnStats struct {
+	count int32
+	open  int32
+}
+
+//New allocates the next connection id
+func (c *ConnStats) New() int32 {
+	return atomic.AddInt32(&c.count, 1)
+}
+
+//Open marks a connection as active
+func (c *ConnStats) Open() int32 {
+	return atomic.AddInt32(&c.open, 1)
+}
+
+//Close marks a connection as no longer active
+func (c *ConnStats) Close() int32 {
+	return atomic.AddInt32(&c.open, -1)
+}
+
+func (c *ConnStats) String() string {
+	return fmt.Sprintf("[%d/%d]", atomic.LoadInt32(&c.open), atomic.LoadInt32(&c.count))
+}
@@ -0,0 +1,319 @@
+package chshare
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+//resumeBufferSize bounds how many unacknowledged bytes a
+//resumableChannel will hold for replay after a reconnect
+const resumeBufferSize = 256 * 1024
+
+//ResumeRequest is the payload of a "chisel-resume" channel opened by
+//a client reconnecting after a dropped connection. It identifies
+//which half-open stream the new channel should re-attach to, and how
+//much of that stream the client has already seen
+type ResumeRequest struct {
+	StreamID      uint32
+	LastAckOffset int64
+}
+
+//EncodeResumeRequest serialises a ResumeRequest for use as SSH
+//channel extra data
+func EncodeResumeRequest(r *ResumeRequest) ([]byte, error) {
+	return json.Marshal(r)
+}
+
+//DecodeResumeRequest is the inverse of EncodeResumeRequest
+func DecodeResumeRequest(data []byte) (*ResumeRequest, error) {
+	r := &ResumeRequest{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//resumeBuffer is a small bounded ring of unacknowledged bytes, kept
+//so a stream can be replayed to a fresh channel after a reconnect.
+//Once a gap exceeds resumeBufferSize the oldest bytes are dropped and
+//resumption from before that point is no longer possible
+type resumeBuffer struct {
+	mu     sync.Mutex
+	buf    []byte
+	offset int64 //stream offset of buf[0]
+}
+
+//Append records bytes that have just been written downstream
+func (b *resumeBuffer) Append(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	if over := len(b.buf) - resumeBufferSize; over > 0 {
+		b.buf = b.buf[over:]
+		b.offset += int64(over)
+	}
+}
+
+//Since returns the buffered bytes from fromOffset onward, for replay.
+//A fromOffset older than what remains buffered means the gap exceeds
+//resumeBufferSize and can no longer be replayed without silently
+//dropping bytes, so ok comes back false instead
+func (b *resumeBuffer) Since(fromOffset int64) (data []byte, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	skip := fromOffset - b.offset
+	if skip < 0 {
+		return nil, false
+	}
+	if int(skip) > len(b.buf) {
+		return []byte{}, true
+	}
+	out := make([]byte, len(b.buf)-int(skip))
+	copy(out, b.buf[skip:])
+	return out, true
+}
+
+//resumableChannel sits between chshare.Pipe and a raw SSH channel,
+//buffering written bytes so that, after a reconnect, Resume can swap
+//in a new channel and replay whatever the other end missed
+type resumableChannel struct {
+	mu         sync.Mutex
+	buf        resumeBuffer
+	rwc        io.ReadWriteCloser
+	recvOffset int64         //bytes read from rwc and handed to the caller so far
+	resumed    chan struct{} //closed and replaced each time Resume swaps in a fresh rwc
+}
+
+func newResumableChannel(rwc io.ReadWriteCloser) *resumableChannel {
+	return &resumableChannel{rwc: rwc, resumed: make(chan struct{})}
+}
+
+func (c *resumableChannel) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	rwc := c.rwc
+	c.mu.Unlock()
+	n, err := rwc.Write(p)
+	if n > 0 {
+		c.buf.Append(p[:n])
+	}
+	return n, err
+}
+
+func (c *resumableChannel) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	rwc := c.rwc
+	c.mu.Unlock()
+	n, err := rwc.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		c.recvOffset += int64(n)
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *resumableChannel) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rwc.Close()
+}
+
+//RecvOffset reports how many bytes this channel has successfully read
+//and handed to its caller so far. A side that is about to reconnect
+//reports its own RecvOffset back as ResumeRequest.LastAckOffset, so the
+//other end's resumeBuffer only replays what this side hasn't already seen
+func (c *resumableChannel) RecvOffset() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.recvOffset
+}
+
+//Resume swaps in a freshly opened channel and replays whatever of the
+//stream the other end has not yet acknowledged. It fails without
+//swapping anything in if lastAckOffset has already fallen out of the
+//replay window, since replaying from the wrong offset would desync
+//the stream rather than just losing it
+func (c *resumableChannel) Resume(rwc io.ReadWriteCloser, lastAckOffset int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	replay, ok := c.buf.Since(lastAckOffset)
+	if !ok {
+		return fmt.Errorf("lastAckOffset %d is outside the %d byte replay window", lastAckOffset, resumeBufferSize)
+	}
+	c.rwc = rwc
+	close(c.resumed)
+	c.resumed = make(chan struct{})
+	if len(replay) == 0 {
+		return nil
+	}
+	_, err := rwc.Write(replay)
+	return err
+}
+
+//awaitResume blocks until Resume re-attaches a fresh rwc to this
+//channel, for a caller that hit an error on the remote side and wants
+//to retry rather than tear the stream down
+func (c *resumableChannel) awaitResume() {
+	c.mu.Lock()
+	ch := c.resumed
+	c.mu.Unlock()
+	<-ch
+}
+
+//streamRegistry tracks the resumableChannels a Tunnel or Proxy has in
+//flight, keyed by the stream id the connection's opener assigned it
+type streamRegistry struct {
+	mu      sync.Mutex
+	streams map[uint32]*resumableChannel
+}
+
+func (s *streamRegistry) register(id uint32, rc *resumableChannel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.streams == nil {
+		s.streams = map[uint32]*resumableChannel{}
+	}
+	s.streams[id] = rc
+}
+
+func (s *streamRegistry) forget(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+//recvOffset reports the RecvOffset of a registered stream, for a side
+//about to ask its peer to resume it. An unknown id (nothing registered,
+//or stream not tagged for resumption) reports 0
+func (s *streamRegistry) recvOffset(id uint32) int64 {
+	s.mu.Lock()
+	rc, ok := s.streams[id]
+	s.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	return rc.RecvOffset()
+}
+
+//resume re-attaches a previously registered stream to a new
+//connection, replaying whatever the other end hasn't acknowledged
+func (s *streamRegistry) resume(id uint32, rwc io.ReadWriteCloser, lastAckOffset int64) error {
+	s.mu.Lock()
+	rc, ok := s.streams[id]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown stream #%d", id)
+	}
+	return rc.Resume(rwc, lastAckOffset)
+}
+
+//ids snapshots the stream ids currently registered
+func (s *streamRegistry) ids() []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]uint32, 0, len(s.streams))
+	for id := range s.streams {
+		out = append(out, id)
+	}
+	return out
+}
+
+//localDeadliner is implemented by the net.Conn types local is always a
+//real instance of (a TCP connection accepted by a Proxy, or one dialled
+//by Tunnel.handleResumableTCP). It lets pipeUntilBreak interrupt a
+//blocked local.Read() without closing local, so an idle local doesn't
+//keep the whole call from returning once remote has already broken
+type localDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+//pipeUntilBreak copies bidirectionally between local (the real src or
+//dst a resumable stream's owner dialled) and remote (the resumable SSH
+//channel to the other end of the tunnel), same as chshare.Pipe, but
+//reports which side caused the copy to stop. An error or close on
+//remote is a candidate for resumption, so localClosed comes back false
+//and local is left open; an error or close on local means the stream is
+//genuinely done
+func pipeUntilBreak(local io.ReadWriteCloser, remote *resumableChannel) (sent, recv int64, localClosed bool) {
+	type result struct {
+		n        int64
+		localEnd bool
+	}
+	sentCh := make(chan result, 1)
+	recvCh := make(chan result, 1)
+	go func() {
+		n, localEnd := copyOne(remote, local, true)
+		sentCh <- result{n, localEnd}
+	}()
+	go func() {
+		n, localEnd := copyOne(local, remote, false)
+		recvCh <- result{n, localEnd}
+	}()
+
+	var sentRes, recvRes result
+	var sentDone, recvDone, forcedLocalRead bool
+	for !sentDone || !recvDone {
+		select {
+		case sentRes = <-sentCh:
+			sentDone = true
+			if sentRes.localEnd {
+				//local ended this direction for real; remote may stay
+				//healthy and block its own direction forever unless we
+				//close it here to force that goroutine to return too
+				remote.Close()
+			}
+		case recvRes = <-recvCh:
+			recvDone = true
+			if !recvRes.localEnd && !sentDone {
+				//remote broke while local is idle: the send-side
+				//goroutine is blocked in local.Read() waiting for data
+				//that may never come, and would otherwise never notice
+				//remote is gone until local next writes (or itself
+				//closes). Force that read to give up instead of
+				//waiting forever; this is an artifact of unblocking it,
+				//not a real local close, so it must not be mistaken for
+				//one below
+				if d, ok := local.(localDeadliner); ok {
+					forcedLocalRead = true
+					d.SetReadDeadline(time.Now())
+				}
+			}
+		}
+	}
+	if forcedLocalRead {
+		//clear the deadline we forced above so the next round (after
+		//Resume swaps in a fresh remote) can block on local as usual
+		if d, ok := local.(localDeadliner); ok {
+			d.SetReadDeadline(time.Time{})
+		}
+		return sentRes.n, recvRes.n, false
+	}
+	return sentRes.n, recvRes.n, sentRes.localEnd || recvRes.localEnd
+}
+
+//copyOne copies from r to w until either end errors or closes,
+//reporting the number of bytes successfully written and whether the
+//terminating condition (a Read error/EOF, or a Write error) occurred on
+//the local side, per readIsLocal
+func copyOne(w io.Writer, r io.Reader, readIsLocal bool) (n int64, localEnd bool) {
+	buf := make([]byte, 32*1024)
+	for {
+		nr, rerr := r.Read(buf)
+		if nr > 0 {
+			nw, werr := w.Write(buf[:nr])
+			n += int64(nw)
+			if werr != nil {
+				return n, !readIsLocal
+			}
+			if nw != nr {
+				return n, !readIsLocal
+			}
+		}
+		if rerr != nil {
+			return n, readIsLocal
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package chshare
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResumeBufferSince(t *testing.T) {
+	var b resumeBuffer
+	b.Append([]byte("hello world"))
+
+	data, ok := b.Since(0)
+	if !ok || string(data) != "hello world" {
+		t.Fatalf("Since(0) = %q, %v, want full buffer", data, ok)
+	}
+
+	data, ok = b.Since(6)
+	if !ok || string(data) != "world" {
+		t.Fatalf("Since(6) = %q, %v, want %q", data, ok, "world")
+	}
+
+	data, ok = b.Since(11)
+	if !ok || len(data) != 0 {
+		t.Fatalf("Since(11) = %q, %v, want empty buffer, ok", data, ok)
+	}
+
+	//an offset past everything written so far isn't a stale-gap error,
+	//it's just nothing to replay yet
+	if data, ok := b.Since(100); !ok || len(data) != 0 {
+		t.Errorf("Since(100) = %q, %v, want empty buffer, ok", data, ok)
+	}
+}
+
+func TestResumeBufferSinceAfterEviction(t *testing.T) {
+	var b resumeBuffer
+	b.Append(bytes.Repeat([]byte("a"), resumeBufferSize+100))
+
+	//the first 100 bytes have fallen out of the window
+	if _, ok := b.Since(0); ok {
+		t.Error("Since(0) should fail once the gap exceeds resumeBufferSize")
+	}
+	if _, ok := b.Since(99); ok {
+		t.Error("Since(99) should still fail, 1 byte short of the window")
+	}
+	data, ok := b.Since(100)
+	if !ok || len(data) != resumeBufferSize {
+		t.Errorf("Since(100) = len %d, %v, want %d, true", len(data), ok, resumeBufferSize)
+	}
+}
+
+func TestResumableChannelResumeReplaysUnacked(t *testing.T) {
+	local, remote := net.Pipe()
+	c := newResumableChannel(local)
+
+	go func() {
+		c.Write([]byte("0123456789"))
+	}()
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(remote, buf); err != nil {
+		t.Fatalf("read original channel: %s", err)
+	}
+	remote.Close()
+	local.Close()
+
+	//the far end only ever acknowledged the first 4 bytes
+	newLocal, newRemote := net.Pipe()
+	replay := make([]byte, 6)
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(newRemote, replay)
+		readErr <- err
+	}()
+	if err := c.Resume(newLocal, 4); err != nil {
+		t.Fatalf("Resume: %s", err)
+	}
+	if err := <-readErr; err != nil {
+		t.Fatalf("read replay: %s", err)
+	}
+	if string(replay) != "456789" {
+		t.Errorf("replay = %q, want %q", replay, "456789")
+	}
+}
+
+func TestPipeUntilBreakUnblocksOnRemoteBreakWithIdleLocal(t *testing.T) {
+	local, _ := net.Pipe() // the peer end is never written to: local.Read() would block forever
+	defer local.Close()
+	remoteLocal, remotePeer := net.Pipe()
+	rc := newResumableChannel(remoteLocal)
+	remotePeer.Close() // break "remote" before local ever produces anything
+
+	done := make(chan bool, 1)
+	go func() {
+		_, _, localClosed := pipeUntilBreak(local, rc)
+		done <- localClosed
+	}()
+
+	select {
+	case localClosed := <-done:
+		if localClosed {
+			t.Error("localClosed should be false when only remote broke, so the stream can be resumed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("pipeUntilBreak hung with an idle local and a broken remote")
+	}
+}
+
+func TestResumableChannelResumeFailsOutsideWindow(t *testing.T) {
+	local, _ := net.Pipe()
+	c := newResumableChannel(local)
+	c.buf.Append(bytes.Repeat([]byte("x"), resumeBufferSize+1))
+
+	newLocal, _ := net.Pipe()
+	if err := c.Resume(newLocal, 0); err == nil {
+		t.Error("Resume should fail when lastAckOffset has fallen out of the replay window")
+	}
+}
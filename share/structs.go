@@ -0,0 +1,102 @@
+package chshare
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+//Config is sent by the client in the first SSH request
+//to configure the remote forwards it would like the
+//server to set up
+type Config struct {
+	Version string
+	Remotes []*Remote
+	//SessionID is a client-chosen identifier that stays stable across
+	//reconnects, letting the server re-attach this config request to
+	//an existing Tunnel (and its in-flight streams) instead of
+	//starting over. Empty disables resumption.
+	SessionID string
+}
+
+//Remote describes a single tunnel endpoint, parsed from
+//a connection string such as "3000:google.com:80" or,
+//for dynamic forwarding, "socks"
+type Remote struct {
+	LocalHost, LocalPort, LocalProto string
+	RemoteHost, RemotePort           string
+	Socks                            bool
+	Stdio                            bool
+	//Reverse marks a remote as server-initiated: the server
+	//listens on RemoteHost:RemotePort and, per accepted conn,
+	//asks the client to dial LocalHost:LocalPort
+	Reverse bool
+}
+
+//Remote returns the host:port this Remote dials on the
+//target side of the tunnel
+func (r *Remote) Remote() string {
+	return r.RemoteHost + ":" + r.RemotePort
+}
+
+func (r *Remote) String() string {
+	if r.Socks {
+		return fmt.Sprintf("%s/%s:%s => socks", r.LocalProto, r.LocalHost, r.LocalPort)
+	}
+	return fmt.Sprintf("%s/%s:%s => %s", r.LocalProto, r.LocalHost, r.LocalPort, r.Remote())
+}
+
+//ParseRemote parses a connection string into a Remote. The usual form
+//is "local_port:remote_host:remote_port"; prefixing with "R:" instead
+//declares a reverse remote of the form "R:bind_host:bind_port:local_host:local_port",
+//which the server listens on and the client dials
+func ParseRemote(s string) (*Remote, error) {
+	if s == "socks" {
+		//matches upstream chisel's dynamic-forward default: bind
+		//loopback-only so the local SOCKS5 proxy isn't reachable from
+		//the network by default
+		return &Remote{LocalProto: "tcp", LocalHost: "127.0.0.1", LocalPort: "1080", Socks: true}, nil
+	}
+	if s == "stdio" {
+		return &Remote{LocalProto: "tcp", Stdio: true}, nil
+	}
+	reverse := false
+	if strings.HasPrefix(s, "R:") {
+		reverse = true
+		s = strings.TrimPrefix(s, "R:")
+	}
+	parts := strings.Split(s, ":")
+	r := &Remote{LocalProto: "tcp", Reverse: reverse}
+	switch len(parts) {
+	case 2:
+		r.LocalPort = parts[0]
+		r.RemotePort = parts[1]
+	case 3:
+		r.LocalPort = parts[0]
+		r.RemoteHost = parts[1]
+		r.RemotePort = parts[2]
+	case 4:
+		r.RemoteHost = parts[0]
+		r.RemotePort = parts[1]
+		r.LocalHost = parts[2]
+		r.LocalPort = parts[3]
+	default:
+		return nil, fmt.Errorf("invalid remote '%s'", s)
+	}
+	return r, nil
+}
+
+//EncodeConfig serialises a Config for transmission as the
+//payload of the initial "config" SSH request
+func EncodeConfig(c *Config) ([]byte, error) {
+	return json.Marshal(c)
+}
+
+//DecodeConfig is the inverse of EncodeConfig
+func DecodeConfig(data []byte) (*Config, error) {
+	c := &Config{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
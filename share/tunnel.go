@@ -0,0 +1,101 @@
+package chshare
+
+import (
+	"context"
+	"fmt"
+
+	socks5 "github.com/armon/go-socks5"
+	"golang.org/x/crypto/ssh"
+)
+
+//Tunnel receives SSH channels opened by the other end of
+//a chisel connection and dispatches them by type
+type Tunnel struct {
+	*Logger
+	connStats   ConnStats
+	socksServer *socks5.Server
+	user        *User
+	streams     streamRegistry
+	hooks       TunnelHooks
+}
+
+//TunnelHooks lets a caller (chserver's metrics subsystem) observe stream
+//lifecycle and byte counts without the Tunnel depending on it directly.
+//Any field left nil is simply not called
+type TunnelHooks struct {
+	StreamOpen  func(user string)
+	StreamClose func(user string)
+	Bytes       func(remote string, sent, recv int64)
+}
+
+//SetHooks installs the hooks a Tunnel reports stream activity through,
+//replacing any previously set
+func (t *Tunnel) SetHooks(h TunnelHooks) {
+	t.hooks = h
+}
+
+//User returns the user this Tunnel was constructed for (nil when
+//authentication is disabled), so a caller considering whether to resume
+//a stashed Tunnel can confirm it still belongs to the reconnecting user
+func (t *Tunnel) User() *User {
+	return t.user
+}
+
+//NewTunnel creates a Tunnel. When socks is true, a SOCKS5
+//server is started to service "socks" typed channels; when
+//user is non-nil, every tcp-forward channel open and every
+//SOCKS dial is gated by user.HasAccess. "udp" channels are
+//not checked against the user's rules
+func NewTunnel(logger *Logger, socks bool, user *User) *Tunnel {
+	t := &Tunnel{
+		Logger: logger,
+		user:   user,
+	}
+	if socks {
+		conf := &socks5.Config{}
+		if user != nil {
+			conf.Rules = &userRuleSet{user, logger.Fork("socks")}
+		}
+		s, err := socks5.New(conf)
+		if err != nil {
+			logger.Debugf("Failed to initialise socks5 server: %s", err)
+		} else {
+			t.socksServer = s
+			logger.Debugf("SOCKS5 enabled")
+		}
+	}
+	return t
+}
+
+//Serve handles the requests and channels opened by the
+//other end of the connection until both are closed
+func (t *Tunnel) Serve(reqs <-chan *ssh.Request, chans <-chan ssh.NewChannel) {
+	go t.handleSSHRequests(reqs)
+	go t.handleSSHChannels(chans)
+}
+
+//userRuleSet gates SOCKS5 dials through a User's ACL,
+//implementing socks5.RuleSet
+type userRuleSet struct {
+	user   *User
+	logger *Logger
+}
+
+func (u *userRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	host := req.DestAddr.FQDN
+	if host == "" {
+		host = req.DestAddr.IP.String()
+	}
+	addr := fmt.Sprintf("%s:%d", host, req.DestAddr.Port)
+	//every dial made through the "socks" channel is gated under the
+	//"socks" scheme, distinct from the "tcp"/"udp" schemes used for
+	//pre-declared forwards, so a user's authfile can scope what its
+	//dynamic SOCKS5 proxy may reach independently of its forwards
+	allowed := u.user.HasAccess("socks", addr)
+	if allowed {
+		u.logger.Infof("Allowed socks dial to %s", addr)
+	} else {
+		u.logger.Infof("Denied socks dial to %s", addr)
+	}
+	return ctx, allowed
+}
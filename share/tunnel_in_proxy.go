@@ -2,8 +2,11 @@ package chshare
 
 import (
 	"context"
+	"encoding/binary"
 	"io"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/jpillora/sizestr"
 	"golang.org/x/crypto/ssh"
@@ -13,17 +16,18 @@ type GetSSHConn func() ssh.Conn
 
 type Proxy struct {
 	*Logger
-	ssh    GetSSHConn
-	id     int
-	count  int
-	remote *Remote
-	dialer net.Dialer
-	tcp    *net.TCPListener
-	udp    *udpListener
+	ssh     GetSSHConn
+	id      int32
+	count   int32
+	remote  *Remote
+	dialer  net.Dialer
+	tcp     *net.TCPListener
+	udp     *udpListener
+	streams streamRegistry
 }
 
 func NewProxy(logger *Logger, ssh GetSSHConn, index int, remote *Remote) (*Proxy, error) {
-	id := index + 1
+	id := int32(index + 1)
 	p := &Proxy{
 		Logger: logger.Fork("proxy#%d: %s", id, remote),
 		ssh:    ssh,
@@ -45,7 +49,7 @@ func (p *Proxy) listen() error {
 		if err != nil {
 			return p.Errorf("tcp: %s", err)
 		}
-		p.Infof("Listening")
+		p.Infof("Listening on %s", l.Addr())
 		p.tcp = l
 	} else if p.remote.LocalProto == "udp" {
 		l, err := bindSSHUDP(p.Logger, p.ssh, p.remote)
@@ -116,28 +120,131 @@ func (p *Proxy) runTCP(ctx context.Context) error {
 }
 
 func (p *Proxy) pipeRemote(src io.ReadWriteCloser) {
-	defer src.Close()
-	p.count++
-	cid := p.count
+	//pipeRemote runs once per accepted connection, concurrently, so the
+	//id it folds into streamID below must be assigned atomically or two
+	//connections accepted back-to-back can land on the same id and
+	//clobber each other's registered stream
+	cid := atomic.AddInt32(&p.count, 1)
 	l := p.Fork("conn#%d", cid)
 	l.Debugf("Open")
 	sshConn := p.ssh()
 	if sshConn == nil {
 		l.Debugf("No remote connection")
+		src.Close()
 		return
 	}
-	//ssh request for tcp connection for this proxy's remote
-	dst, reqs, err := sshConn.OpenChannel("chisel", []byte(p.remote.Remote()))
+	//ssh request for tcp connection for this proxy's remote,
+	//or, for dynamic forwarding, the "socks" sentinel in place
+	//of a pre-declared destination
+	extra := p.remote.Remote()
+	if p.remote.Socks {
+		extra = "socks"
+	}
+	dst, reqs, err := sshConn.OpenChannel("chisel", []byte(extra))
 	if err != nil {
 		l.Infof("Stream error: %s", err)
+		src.Close()
 		return
 	}
 	go ssh.DiscardRequests(reqs)
-	//then pipe
-	s, r := Pipe(src, dst)
+	//tag this stream with its id so a later reconnect can ask the
+	//server to re-attach a fresh channel to it; plain tcp forwards
+	//only - socks destinations are chosen per-dial inside the tunnel
+	//and stdio has nothing meaningful to resume into
+	var streamID uint32
+	if !p.remote.Socks && !p.remote.Stdio {
+		//the server's streamRegistry is shared by every Proxy on this
+		//connection, so namespace each id by proxy - cid alone would
+		//collide as soon as two remotes both opened connection #1.
+		//Only 8 bits go to the proxy index (a config realistically
+		//declares far fewer than 256 remotes) so cid keeps the
+		//remaining 24 bits; with 16 it would wrap - and collide with
+		//an older, still-registered stream - after just 65536
+		//connections through one long-lived proxy
+		streamID = uint32(p.id&0xff)<<24 | uint32(cid)&0xffffff
+		idBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(idBytes, streamID)
+		dst.SendRequest("stream-id", false, idBytes)
+	}
+	rc := newResumableChannel(dst)
+	if streamID == 0 {
+		//not resumable - pipe once and close both ends for good when it ends
+		defer src.Close()
+		s, r := Pipe(src, rc)
+		l.Debugf("Close (sent %s received %s)", sizestr.ToString(s), sizestr.ToString(r))
+		return
+	}
+	p.streams.register(streamID, rc)
+	s, r := p.pipeResumable(l, src, rc, streamID)
 	l.Debugf("Close (sent %s received %s)", sizestr.ToString(s), sizestr.ToString(r))
 }
 
+//pipeResumable pipes between src and rc like Pipe, but when the break
+//originates on rc (the remote SSH channel, dropped by a disconnect)
+//it leaves src open and the stream registered, and waits for Resume to
+//swap in a fresh channel before retrying. It only closes src and
+//forgets the stream once the break originates on src itself
+func (p *Proxy) pipeResumable(l *Logger, src io.ReadWriteCloser, rc *resumableChannel, streamID uint32) (sent, recv int64) {
+	defer p.streams.forget(streamID)
+	defer src.Close()
+	for {
+		s, r, localClosed := pipeUntilBreak(src, rc)
+		sent += s
+		recv += r
+		if localClosed {
+			return sent, recv
+		}
+		l.Debugf("Stream #%d paused, waiting to resume", streamID)
+		rc.awaitResume()
+		l.Debugf("Stream #%d resumed", streamID)
+	}
+}
+
+//Resume re-opens a "chisel-resume" channel for every stream this
+//proxy still has in flight, swapping each one onto the freshly
+//(re)established SSH connection. Intended to be called by the
+//client's reconnect loop once GetSSHConn starts returning a live
+//ssh.Conn again after a drop
+func (p *Proxy) Resume(conn ssh.Conn) {
+	for _, id := range p.streams.ids() {
+		//tell the server how much of *its* stream to us we've already
+		//received, so it only replays what we're actually missing
+		payload, err := EncodeResumeRequest(&ResumeRequest{
+			StreamID:      id,
+			LastAckOffset: p.streams.recvOffset(id),
+		})
+		if err != nil {
+			continue
+		}
+		ch, reqs, err := conn.OpenChannel("chisel-resume", payload)
+		if err != nil {
+			p.Debugf("Resume #%d failed: %s", id, err)
+			continue
+		}
+		//the other end replies with a "stream-ack" naming how much of
+		//our own stream to it has already arrived, so our replay below
+		//only resends what's actually missing; give it a brief window
+		//to arrive before falling back to replaying everything we still
+		//have buffered
+		var lastAckOffset int64
+		select {
+		case req, ok := <-reqs:
+			if ok && req.Type == "stream-ack" && len(req.Payload) == 8 {
+				lastAckOffset = int64(binary.BigEndian.Uint64(req.Payload))
+			}
+			if ok && req.WantReply {
+				req.Reply(true, nil)
+			}
+		case <-time.After(200 * time.Millisecond):
+		}
+		go ssh.DiscardRequests(reqs)
+		if err := p.streams.resume(id, ch, lastAckOffset); err != nil {
+			p.Debugf("Resume #%d failed: %s", id, err)
+			ch.Close()
+		}
+	}
+}
+
 //TCPProxy makes this package backward compatible
 type TCPProxy = Proxy
 
@@ -1,9 +1,12 @@
 package chshare
 
 import (
+	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/jpillora/sizestr"
 	"golang.org/x/crypto/ssh"
@@ -27,33 +30,88 @@ func (t *Tunnel) handleSSHChannels(chans <-chan ssh.NewChannel) {
 }
 
 func (t *Tunnel) handleSSHChannel(ch ssh.NewChannel) {
+	//a "chisel-resume" channel re-attaches an existing stream after a
+	//reconnect rather than starting a new one
+	if ch.ChannelType() == "chisel-resume" {
+		t.handleResumeChannel(ch)
+		return
+	}
+	//a reverse channel carries the local_host:local_port the
+	//server wants this end to dial on its behalf
+	reverse := ch.ChannelType() == "chisel-reverse"
 	remote := string(ch.ExtraData())
-	udp := remote == "udp"
-	socks := remote == "socks"
+	udp := !reverse && remote == "udp"
+	socks := !reverse && remote == "socks"
 	if socks && t.socksServer == nil {
 		t.Debugf("Denied socks request, please enable socks")
 		ch.Reject(ssh.Prohibited, "SOCKS5 is not enabled")
 		return
 	}
+	//gate every plain tcp-forward channel against the user's ACL here,
+	//not just against the remotes declared at config time - a client
+	//can otherwise open a channel for any destination it likes. udp
+	//can't be gated the same way: the channel's extra data is just the
+	//"udp" sentinel, not a destination (that's carried per-packet once
+	//the channel is open, same as socks), so there's no addr here for
+	//HasAccess to check
+	if !socks && !udp && !reverse && t.user != nil {
+		if !t.user.HasAccess("tcp", remote) {
+			t.Infof("Denied tcp dial to %s", remote)
+			ch.Reject(ssh.Prohibited, fmt.Sprintf("access to '%s' denied", remote))
+			return
+		}
+		t.Infof("Allowed tcp dial to %s", remote)
+	}
 	stream, reqs, err := ch.Accept()
 	if err != nil {
 		t.Debugf("Failed to accept stream: %s", err)
 		return
 	}
 	defer stream.Close()
+	//a plain tcp forward may carry a "stream-id" request right after
+	//open, tagging it for later resumption via a "chisel-resume"
+	//channel; give it a brief window to arrive before falling back to
+	//an ordinary, non-resumable stream
+	var streamID uint32
+	if !reverse && !udp && !socks {
+		select {
+		case req, ok := <-reqs:
+			if ok && req.Type == "stream-id" && len(req.Payload) == 4 {
+				streamID = binary.BigEndian.Uint32(req.Payload)
+			}
+			if ok && req.WantReply {
+				req.Reply(true, nil)
+			}
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
 	go ssh.DiscardRequests(reqs)
 	l := t.Logger.Fork("conn#%d", t.connStats.New())
 	//ready to handle
 	t.connStats.Open()
+	userName := ""
+	if t.user != nil {
+		userName = t.user.Name
+	}
+	if t.hooks.StreamOpen != nil {
+		t.hooks.StreamOpen(userName)
+	}
 	l.Debugf("Open %s", t.connStats.String())
 	if socks {
 		err = t.handleSocks(stream)
 	} else if udp {
 		err = t.handleUDP(l, stream)
+	} else if streamID != 0 {
+		rc := newResumableChannel(stream)
+		t.streams.register(streamID, rc)
+		err = t.handleResumableTCP(l, rc, remote, streamID)
 	} else {
 		err = t.handleTCP(l, stream, remote)
 	}
 	t.connStats.Close()
+	if t.hooks.StreamClose != nil {
+		t.hooks.StreamClose(userName)
+	}
 	if err != nil && !strings.HasSuffix(err.Error(), "EOF") {
 		l.Debugf("Close %s (error %s)", t.connStats.String(), err)
 	} else {
@@ -61,6 +119,36 @@ func (t *Tunnel) handleSSHChannel(ch ssh.NewChannel) {
 	}
 }
 
+//handleResumeChannel re-attaches a "chisel-resume" channel to the
+//stream its ResumeRequest names, replaying any bytes the other end
+//has not yet acknowledged
+func (t *Tunnel) handleResumeChannel(ch ssh.NewChannel) {
+	req, err := DecodeResumeRequest(ch.ExtraData())
+	if err != nil {
+		ch.Reject(ssh.Prohibited, "invalid resume request")
+		return
+	}
+	stream, reqs, err := ch.Accept()
+	if err != nil {
+		t.Debugf("Failed to accept resume stream: %s", err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	//tell the client how much of its stream to us has already arrived,
+	//so its own replay (via this same swap) only resends what we're
+	//actually missing, rather than re-delivering bytes the destination
+	//dial already saw
+	ackBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(ackBytes, uint64(t.streams.recvOffset(req.StreamID)))
+	stream.SendRequest("stream-ack", false, ackBytes)
+	if err := t.streams.resume(req.StreamID, stream, req.LastAckOffset); err != nil {
+		t.Debugf("Resume #%d failed: %s", req.StreamID, err)
+		stream.Close()
+		return
+	}
+	t.Infof("Resumed stream #%d", req.StreamID)
+}
+
 func (t *Tunnel) handleSocks(src io.ReadWriteCloser) error {
 	return t.socksServer.ServeConn(NewRWCConn(src))
 }
@@ -72,5 +160,42 @@ func (t *Tunnel) handleTCP(l *Logger, src io.ReadWriteCloser, remote string) err
 	}
 	s, r := Pipe(src, dst)
 	l.Debugf("sent %s received %s", sizestr.ToString(s), sizestr.ToString(r))
+	if t.hooks.Bytes != nil {
+		t.hooks.Bytes(remote, s, r)
+	}
+	return nil
+}
+
+//handleResumableTCP is handleTCP for a stream tagged for resumption: the
+//destination dial is kept open across a break on rc (the client-facing
+//channel, torn down by a disconnect) instead of being closed with it, so
+//a later "chisel-resume" channel can reattach to the same dial. The dial
+//and the stream's registry entry are only torn down for good once the
+//dial itself ends
+func (t *Tunnel) handleResumableTCP(l *Logger, rc *resumableChannel, remote string, streamID uint32) error {
+	dst, err := net.Dial("tcp", remote)
+	if err != nil {
+		return err
+	}
+	defer t.streams.forget(streamID)
+	defer dst.Close()
+	var sent, recv int64
+	for {
+		//dst is pipeUntilBreak's local side here, so its first count is
+		//what came back from dst; swap to match handleTCP's sent/received
+		s, r, dstClosed := pipeUntilBreak(dst, rc)
+		sent += r
+		recv += s
+		if dstClosed {
+			break
+		}
+		l.Debugf("Stream #%d paused, waiting to resume", streamID)
+		rc.awaitResume()
+		l.Debugf("Stream #%d resumed", streamID)
+	}
+	l.Debugf("sent %s received %s", sizestr.ToString(sent), sizestr.ToString(recv))
+	if t.hooks.Bytes != nil {
+		t.hooks.Bytes(remote, sent, recv)
+	}
 	return nil
 }
@@ -0,0 +1,182 @@
+package chshare
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+//User represents a client login and the set of destination
+//rules it is permitted (or forbidden) to dial
+type User struct {
+	Name  string
+	Pass  string
+	rules []*aclRule
+}
+
+//Users is a set of User, keyed by login name
+type Users map[string]*User
+
+//aclRule is one compiled entry of a User's destination ACL.
+//Rules are evaluated in declaration order and the first match wins
+type aclRule struct {
+	deny           bool
+	scheme         string   //"" matches any of tcp/udp/socks
+	cidr           *net.IPNet
+	host           string   //"" matches any host (a "*" host compiles to "")
+	portLo, portHi int      //0,0 matches any port
+}
+
+//HasAccess reports whether this user may dial addr ("host:port")
+//over the given scheme ("tcp", "udp" or "socks"). An empty rule set
+//grants access to everything; otherwise the first matching rule
+//(allow or deny) decides, and no match means deny.
+func (u *User) HasAccess(scheme, addr string) bool {
+	if len(u.rules) == 0 {
+		return true
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	for _, r := range u.rules {
+		if r.matches(scheme, host, port) {
+			return !r.deny
+		}
+	}
+	return false
+}
+
+func (r *aclRule) matches(scheme, host string, port int) bool {
+	if r.scheme != "" && r.scheme != scheme {
+		return false
+	}
+	if r.cidr != nil {
+		ip := net.ParseIP(host)
+		if ip == nil || !r.cidr.Contains(ip) {
+			return false
+		}
+	} else if r.host != "" && !matchHost(r.host, host) {
+		return false
+	}
+	if r.portLo != 0 && (port < r.portLo || port > r.portHi) {
+		return false
+	}
+	return true
+}
+
+//matchHost supports an exact match or a "*.example.com" style
+//leading wildcard
+func matchHost(pattern, host string) bool {
+	if pattern == host {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return false
+}
+
+//ParseUsers reads a users authentication file of the form
+//  {"<user>:<pass>": ["<rule>", ...]}
+//an empty rule list grants access to all remotes. Each rule is
+//  [!][scheme://]host[:port]
+//where scheme is one of tcp/udp/socks (default any), host may be a
+//literal, a "*.example.com" wildcard, "*" for any host, or a CIDR
+//block such as "10.0.0.0/8", and port may be a single number, a
+//"low-high" range, or "*"/omitted for any port. A leading "!" makes
+//the rule a deny instead of an allow.
+func ParseUsers(authfile string) (Users, error) {
+	b, err := ioutil.ReadFile(authfile)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string][]string{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("invalid authfile: %s", err)
+	}
+	users := Users{}
+	for auth, rules := range raw {
+		name, pass, err := splitAuth(auth)
+		if err != nil {
+			return nil, err
+		}
+		u := &User{Name: name, Pass: pass}
+		for _, raw := range rules {
+			rule, err := compileRule(raw)
+			if err != nil {
+				return nil, fmt.Errorf("user '%s': %s", name, err)
+			}
+			u.rules = append(u.rules, rule)
+		}
+		users[name] = u
+	}
+	return users, nil
+}
+
+func splitAuth(auth string) (user, pass string, err error) {
+	i := strings.Index(auth, ":")
+	if i < 0 {
+		return "", "", fmt.Errorf("invalid auth entry '%s', expecting <user>:<pass>", auth)
+	}
+	return auth[:i], auth[i+1:], nil
+}
+
+func compileRule(raw string) (*aclRule, error) {
+	deny := false
+	if strings.HasPrefix(raw, "!") {
+		deny = true
+		raw = raw[1:]
+	}
+	scheme := ""
+	if i := strings.Index(raw, "://"); i >= 0 {
+		scheme = raw[:i]
+		raw = raw[i+3:]
+	}
+	host, portSpec := raw, ""
+	if i := strings.LastIndex(raw, ":"); i >= 0 {
+		host, portSpec = raw[:i], raw[i+1:]
+	}
+	r := &aclRule{deny: deny, scheme: scheme}
+	if host != "" && host != "*" {
+		if _, ipnet, err := net.ParseCIDR(host); err == nil {
+			r.cidr = ipnet
+		} else {
+			r.host = host
+		}
+	}
+	if portSpec != "" && portSpec != "*" {
+		lo, hi, err := parsePortRange(portSpec)
+		if err != nil {
+			return nil, err
+		}
+		r.portLo, r.portHi = lo, hi
+	}
+	return r, nil
+}
+
+func parsePortRange(spec string) (lo, hi int, err error) {
+	if i := strings.Index(spec, "-"); i >= 0 {
+		lo, err = strconv.Atoi(spec[:i])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid port range '%s'", spec)
+		}
+		hi, err = strconv.Atoi(spec[i+1:])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid port range '%s'", spec)
+		}
+		return lo, hi, nil
+	}
+	port, err := strconv.Atoi(spec)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port '%s'", spec)
+	}
+	return port, port, nil
+}
@@ -0,0 +1,119 @@
+package chshare
+
+import "testing"
+
+func TestUserHasAccess(t *testing.T) {
+	cases := []struct {
+		name   string
+		rules  []string
+		scheme string
+		addr   string
+		want   bool
+	}{
+		{
+			name:   "no rules allows everything",
+			rules:  nil,
+			scheme: "tcp",
+			addr:   "example.com:22",
+			want:   true,
+		},
+		{
+			name:   "no match denies",
+			rules:  []string{"allowed.com:80"},
+			scheme: "tcp",
+			addr:   "example.com:80",
+			want:   false,
+		},
+		{
+			name:   "exact host and port",
+			rules:  []string{"example.com:80"},
+			scheme: "tcp",
+			addr:   "example.com:80",
+			want:   true,
+		},
+		{
+			name:   "wildcard host",
+			rules:  []string{"*.example.com:80"},
+			scheme: "tcp",
+			addr:   "foo.example.com:80",
+			want:   true,
+		},
+		{
+			name:   "cidr match",
+			rules:  []string{"10.0.0.0/8"},
+			scheme: "tcp",
+			addr:   "10.1.2.3:443",
+			want:   true,
+		},
+		{
+			name:   "cidr miss",
+			rules:  []string{"10.0.0.0/8"},
+			scheme: "tcp",
+			addr:   "192.168.1.1:443",
+			want:   false,
+		},
+		{
+			name:   "port range match",
+			rules:  []string{"example.com:8000-8100"},
+			scheme: "tcp",
+			addr:   "example.com:8050",
+			want:   true,
+		},
+		{
+			name:   "port range miss",
+			rules:  []string{"example.com:8000-8100"},
+			scheme: "tcp",
+			addr:   "example.com:9000",
+			want:   false,
+		},
+		{
+			name:   "scheme scoped rule ignores other schemes",
+			rules:  []string{"socks://example.com:80"},
+			scheme: "tcp",
+			addr:   "example.com:80",
+			want:   false,
+		},
+		{
+			name:   "deny rule wins when it matches first",
+			rules:  []string{"!example.com:80", "*:*"},
+			scheme: "tcp",
+			addr:   "example.com:80",
+			want:   false,
+		},
+		{
+			name:   "first match wins over a later deny",
+			rules:  []string{"*.example.com:*", "!secret.example.com:*"},
+			scheme: "tcp",
+			addr:   "secret.example.com:80",
+			want:   true,
+		},
+		{
+			name:   "explicit port 0 is indistinguishable from no port restriction",
+			rules:  []string{"example.com:0"},
+			scheme: "tcp",
+			addr:   "example.com:12345",
+			want:   true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			u := &User{Name: "test"}
+			for _, raw := range c.rules {
+				rule, err := compileRule(raw)
+				if err != nil {
+					t.Fatalf("compileRule(%q): %s", raw, err)
+				}
+				u.rules = append(u.rules, rule)
+			}
+			if got := u.HasAccess(c.scheme, c.addr); got != c.want {
+				t.Errorf("HasAccess(%q, %q) = %v, want %v", c.scheme, c.addr, got, c.want)
+			}
+		})
+	}
+}
+
+func TestCompileRuleInvalidPort(t *testing.T) {
+	if _, err := compileRule("example.com:not-a-port"); err == nil {
+		t.Error("expected an error for a non-numeric port")
+	}
+}